@@ -0,0 +1,81 @@
+package graphdriver
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+)
+
+// fakeCompressedDiffer is a ProtoDriver that also natively implements
+// CompressedDiffer, the capability DiffWithOptions is supposed to prefer
+// over its own naive tar-then-compress path.
+type fakeCompressedDiffer struct {
+	*fakeProtoDriver
+	called bool
+	opts   DiffOptions
+}
+
+func (f *fakeCompressedDiffer) DiffWithOptions(id, parent string, opts DiffOptions) (io.ReadCloser, error) {
+	f.called = true
+	f.opts = opts
+	return io.NopCloser(strings.NewReader("native")), nil
+}
+
+func TestDiffWithOptionsDelegatesToCompressedDiffer(t *testing.T) {
+	fd := &fakeCompressedDiffer{fakeProtoDriver: newFakeProtoDriver(t)}
+	gdw := &NaiveDiffDriver{ProtoDriver: fd, cache: newChangeCache(changeCacheCapacity)}
+
+	rc, err := gdw.DiffWithOptions("id", "parent", DiffOptions{Compression: archive.Gzip})
+	if err != nil {
+		t.Fatalf("DiffWithOptions: %v", err)
+	}
+	defer rc.Close()
+
+	if !fd.called {
+		t.Fatalf("expected DiffWithOptions to delegate to the native CompressedDiffer")
+	}
+	if fd.opts.Compression != archive.Gzip {
+		t.Errorf("expected the requested compression to be passed through, got %v", fd.opts.Compression)
+	}
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading native diff: %v", err)
+	}
+	if string(data) != "native" {
+		t.Errorf("expected the native CompressedDiffer's output to be returned unmodified, got %q", data)
+	}
+}
+
+func TestDiffWithOptionsFallsBackToNaiveCompression(t *testing.T) {
+	pd := newFakeProtoDriver(t)
+	layerDir, err := pd.Get("base", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layerDir, "file"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	gdw := &NaiveDiffDriver{ProtoDriver: pd, cache: newChangeCache(changeCacheCapacity)}
+
+	rc, err := gdw.DiffWithOptions("base", "", DiffOptions{Compression: archive.Gzip})
+	if err != nil {
+		t.Fatalf("DiffWithOptions: %v", err)
+	}
+	defer rc.Close()
+
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		t.Fatalf("expected a gzip-compressed naive tar, got: %v", err)
+	}
+	defer gz.Close()
+	if _, err := io.ReadAll(gz); err != nil {
+		t.Errorf("expected the naive tar to decompress cleanly, got: %v", err)
+	}
+}
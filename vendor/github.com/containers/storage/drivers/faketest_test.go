@@ -0,0 +1,108 @@
+package graphdriver
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+)
+
+// fakeProtoDriver is a minimal ProtoDriver backed by plain directories under
+// a temp root, for tests that only need Get/Put semantics and don't care
+// about real mount/unmount behavior.
+type fakeProtoDriver struct {
+	root string
+}
+
+func newFakeProtoDriver(t *testing.T) *fakeProtoDriver {
+	return &fakeProtoDriver{root: t.TempDir()}
+}
+
+func (f *fakeProtoDriver) layerDir(id string) string {
+	return filepath.Join(f.root, id)
+}
+
+func (f *fakeProtoDriver) String() string { return "fake" }
+
+func (f *fakeProtoDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	return os.MkdirAll(f.layerDir(id), 0o755)
+}
+
+func (f *fakeProtoDriver) Create(id, parent string, opts *CreateOpts) error {
+	return os.MkdirAll(f.layerDir(id), 0o755)
+}
+
+func (f *fakeProtoDriver) Remove(id string) error {
+	return os.RemoveAll(f.layerDir(id))
+}
+
+func (f *fakeProtoDriver) Get(id, mountLabel string) (string, error) {
+	dir := f.layerDir(id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (f *fakeProtoDriver) Put(id string) error { return nil }
+
+func (f *fakeProtoDriver) Exists(id string) bool {
+	_, err := os.Stat(f.layerDir(id))
+	return err == nil
+}
+
+func (f *fakeProtoDriver) Status() [][2]string { return nil }
+
+func (f *fakeProtoDriver) Metadata(id string) (map[string]string, error) { return nil, nil }
+
+func (f *fakeProtoDriver) Cleanup() error { return nil }
+
+func (f *fakeProtoDriver) AdditionalImageStores() []string { return nil }
+
+// fakeDiffer is a ProtoDriver that also natively implements Differ, the
+// shape NewNaiveDiffDriver is supposed to detect and return unwrapped.
+type fakeDiffer struct {
+	*fakeProtoDriver
+}
+
+func (f *fakeDiffer) Diff(id, parent string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *fakeDiffer) Changes(id, parent string) ([]archive.Change, error) { return nil, nil }
+
+func (f *fakeDiffer) ApplyDiff(id, parent string, diff io.Reader) (int64, error) { return 0, nil }
+
+func (f *fakeDiffer) DiffSize(id, parent string) (int64, error) { return 0, nil }
+
+func TestNewNaiveDiffDriverPassthroughAndWrap(t *testing.T) {
+	t.Run("native Differ is returned unwrapped", func(t *testing.T) {
+		fd := &fakeDiffer{fakeProtoDriver: newFakeProtoDriver(t)}
+
+		got := NewNaiveDiffDriver(fd, nil, nil)
+
+		if got != Driver(fd) {
+			t.Errorf("expected NewNaiveDiffDriver to return the native Differ unchanged")
+		}
+		if _, ok := got.(*NaiveDiffDriver); ok {
+			t.Errorf("expected a driver that already implements Differ not to be wrapped in NaiveDiffDriver")
+		}
+	})
+
+	t.Run("plain ProtoDriver is wrapped", func(t *testing.T) {
+		pd := newFakeProtoDriver(t)
+
+		got := NewNaiveDiffDriver(pd, nil, nil)
+
+		ndd, ok := got.(*NaiveDiffDriver)
+		if !ok {
+			t.Fatalf("expected a plain ProtoDriver to be wrapped in *NaiveDiffDriver, got %T", got)
+		}
+		if ndd.ProtoDriver != ProtoDriver(pd) {
+			t.Errorf("expected the wrapped driver to embed the original ProtoDriver")
+		}
+	})
+}
@@ -1,7 +1,13 @@
 package graphdriver
 
 import (
+	"context"
 	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/containers/storage/pkg/archive"
@@ -15,8 +21,180 @@ var (
 	// ApplyUncompressedLayer defines the unpack method used by the graph
 	// driver.
 	ApplyUncompressedLayer = chrootarchive.ApplyUncompressedLayer
+
+	// ChangesParallelism caps the number of goroutines NaiveDiffDriver uses
+	// to walk a layer and its parent concurrently in Changes/DiffSize.
+	ChangesParallelism = runtime.NumCPU()
+
+	// changeCacheCapacity is the number of (id, parent, generation) entries
+	// NaiveDiffDriver's change cache keeps before evicting the least
+	// recently used one.
+	changeCacheCapacity = 64
 )
 
+// LayerMountGenerationer can be implemented by a ProtoDriver whose layers can
+// change content across Gets without going through ApplyDiff/Create/Remove
+// (for example, a driver that lets callers write directly into a mounted
+// layer). NaiveDiffDriver includes the returned generation in its change
+// cache key so such drivers still get correctly invalidated results; drivers
+// that don't implement it are assumed to only change content through the
+// calls NaiveDiffDriver already knows to invalidate.
+type LayerMountGenerationer interface {
+	LayerMountGeneration(id string) (uint64, error)
+}
+
+// ChangeCacheParticipant lets the wrapped ProtoDriver opt out of
+// NaiveDiffDriver's Changes/DiffSize cache entirely, e.g. because it
+// maintains its own, more precise cache already.
+type ChangeCacheParticipant interface {
+	ParticipatesInChangeCache() bool
+}
+
+// changeCacheKey identifies one cached Changes/DiffSize result.
+type changeCacheKey struct {
+	id, parent string
+	generation uint64
+}
+
+type changeCacheValue struct {
+	changes []archive.Change
+	size    int64
+}
+
+// changeCache is a small, fixed-capacity, least-recently-used cache of
+// Changes/DiffSize results. It is safe for concurrent use.
+type changeCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    []changeCacheKey // least recently used first
+	entries  map[changeCacheKey]changeCacheValue
+}
+
+func newChangeCache(capacity int) *changeCache {
+	return &changeCache{
+		capacity: capacity,
+		entries:  make(map[changeCacheKey]changeCacheValue),
+	}
+}
+
+func (c *changeCache) get(key changeCacheKey) (changeCacheValue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[key]
+	if ok {
+		c.touch(key)
+	}
+	return v, ok
+}
+
+func (c *changeCache) put(key changeCacheKey, v changeCacheValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.capacity && len(c.order) > 0 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = v
+	c.touch(key)
+}
+
+// touch must be called with c.mu held.
+func (c *changeCache) touch(key changeCacheKey) {
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, key)
+}
+
+// invalidate drops every cached entry that mentions id as either the layer
+// or the parent.
+func (c *changeCache) invalidate(id string) {
+	if id == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := c.order[:0]
+	for _, key := range c.order {
+		if key.id == id || key.parent == id {
+			delete(c.entries, key)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	c.order = kept
+}
+
+// DiffOptions carries optional, best-effort controls for DiffContext and
+// ApplyDiffContext. A nil *DiffOptions behaves exactly like the plain
+// Diff/ApplyDiff methods.
+type DiffOptions struct {
+	// Progress, when set, is called periodically with the cumulative
+	// number of bytes processed so far. It may be called from whatever
+	// goroutine is reading the returned archive or driving the
+	// extraction, and must not block for long.
+	//
+	// Progress reports bytes only, not a file count: ctxReader wraps a
+	// raw byte stream with no notion of tar entry boundaries, so a files-
+	// processed count isn't something it can produce without parsing the
+	// tar structure itself.
+	Progress func(bytesProcessed int64)
+
+	// Compression selects the codec DiffWithOptions compresses its output
+	// with: archive.Uncompressed (the default), archive.Gzip, archive.Zstd,
+	// or any codec registered with archive.RegisterCompressionFormat. Diff,
+	// DiffContext, and ApplyDiffContext ignore this field.
+	Compression archive.Compression
+}
+
+// CompressedDiffer is an optional capability a Differ can implement to
+// produce its Diff output already compressed, e.g. straight out of a
+// send/receive stream, instead of having NaiveDiffDriver recompress a plain
+// tar on top of it.
+type CompressedDiffer interface {
+	DiffWithOptions(id, parent string, opts DiffOptions) (io.ReadCloser, error)
+}
+
+// ctxReader wraps an io.Reader so that Read fails with ctx.Err() as soon as
+// ctx is cancelled, instead of running the tar walk or extraction to
+// completion, and so that opts.Progress (if any) is kept up to date.
+type ctxReader struct {
+	ctx   context.Context
+	r     io.Reader
+	opts  *DiffOptions
+	bytes int64
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cr.r.Read(p)
+	if n > 0 {
+		cr.bytes += int64(n)
+		if cr.opts != nil && cr.opts.Progress != nil {
+			cr.opts.Progress(cr.bytes)
+		}
+	}
+	return n, err
+}
+
+// Differ can be implemented by a ProtoDriver to provide a native, driver
+// specific implementation of the diffing methods below instead of relying on
+// the generic tar-walk based NaiveDiffDriver. Drivers such as overlay2,
+// btrfs, or zfs can satisfy this directly off of a snapshot diff or
+// send/receive stream, without ever mounting both layers.
+type Differ interface {
+	Diff(id, parent string) (io.ReadCloser, error)
+	Changes(id, parent string) ([]archive.Change, error)
+	ApplyDiff(id, parent string, diff io.Reader) (size int64, err error)
+	DiffSize(id, parent string) (size int64, err error)
+}
+
 // NaiveDiffDriver takes a ProtoDriver and adds the
 // capability of the Diffing methods which it may or may not
 // support on its own. See the comment on the exported
@@ -26,6 +204,7 @@ type NaiveDiffDriver struct {
 	ProtoDriver
 	uidMaps []idtools.IDMap
 	gidMaps []idtools.IDMap
+	cache   *changeCache
 }
 
 // NewNaiveDiffDriver returns a fully functional driver that wraps the
@@ -35,15 +214,72 @@ type NaiveDiffDriver struct {
 //     Changes(id, parent string) ([]archive.Change, error)
 //     ApplyDiff(id, parent string, diff io.Reader) (size int64, err error)
 //     DiffSize(id, parent string) (size int64, err error)
+//
+// If driver already satisfies Differ, meaning it implements these methods
+// natively, it is returned as-is: wrapping it here would only throw away the
+// driver's own (usually much cheaper) implementation in favor of the naive
+// tar-walk one. Callers should not type-assert against NaiveDiffDriver or any
+// other private type to detect this; they get a Driver either way.
+//
+// That guarantee covers only the four Differ methods above, which are part
+// of the Driver interface. DiffContext, ApplyDiffContext, DiffWithOptions,
+// ChangesChain, and DiffChain are not: they're concrete additions on
+// *NaiveDiffDriver itself (or whatever native capability interface a driver
+// implements, like CompressedDiffer for DiffWithOptions). A caller that only
+// holds the Driver this function returns can't reach them without a type
+// assertion of its own against *NaiveDiffDriver or the matching capability
+// interface.
 func NewNaiveDiffDriver(driver ProtoDriver, uidMaps, gidMaps []idtools.IDMap) Driver {
+	if d, ok := driver.(Driver); ok {
+		return d
+	}
 	return &NaiveDiffDriver{ProtoDriver: driver,
 		uidMaps: uidMaps,
-		gidMaps: gidMaps}
+		gidMaps: gidMaps,
+		cache:   newChangeCache(changeCacheCapacity)}
+}
+
+// generation returns the wrapped ProtoDriver's mount generation for id if it
+// implements LayerMountGenerationer, and 0 otherwise.
+func (gdw *NaiveDiffDriver) generation(id string) uint64 {
+	g, ok := gdw.ProtoDriver.(LayerMountGenerationer)
+	if !ok {
+		return 0
+	}
+	gen, err := g.LayerMountGeneration(id)
+	if err != nil {
+		return 0
+	}
+	return gen
+}
+
+// cacheEnabled reports whether the wrapped ProtoDriver wants to participate
+// in the change cache. Drivers that don't implement ChangeCacheParticipant
+// participate by default.
+func (gdw *NaiveDiffDriver) cacheEnabled() bool {
+	p, ok := gdw.ProtoDriver.(ChangeCacheParticipant)
+	return !ok || p.ParticipatesInChangeCache()
 }
 
 // Diff produces an archive of the changes between the specified
 // layer and its parent layer which may be "".
-func (gdw *NaiveDiffDriver) Diff(id, parent string) (arch io.ReadCloser, err error) {
+func (gdw *NaiveDiffDriver) Diff(id, parent string) (io.ReadCloser, error) {
+	return gdw.DiffContext(context.Background(), id, parent, nil)
+}
+
+// DiffContext is the context-aware, cancellable form of Diff. The tree walk
+// that computes changes against parent is itself cancellable, checking ctx
+// between top-level entries the same way changesDirsParallel fans its work
+// out, so a caller cancelling mid-walk on a layer with millions of inodes
+// doesn't have to wait for it to finish. Reads from the returned archive
+// also fail with ctx.Err() as soon as ctx is cancelled, instead of running
+// the tar streaming through to completion, and opts.Progress (if set) is
+// kept up to date with bytes processed along the way.
+func (gdw *NaiveDiffDriver) DiffContext(ctx context.Context, id, parent string, opts *DiffOptions) (arch io.ReadCloser, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	startTime := time.Now()
 	driver := gdw.ProtoDriver
 
@@ -63,7 +299,8 @@ func (gdw *NaiveDiffDriver) Diff(id, parent string) (arch io.ReadCloser, err err
 		if err != nil {
 			return nil, err
 		}
-		return ioutils.NewReadCloserWrapper(archive, func() error {
+		cr := &ctxReader{ctx: ctx, r: archive, opts: opts}
+		return ioutils.NewReadCloserWrapper(cr, func() error {
 			err := archive.Close()
 			driver.Put(id)
 			return err
@@ -76,7 +313,7 @@ func (gdw *NaiveDiffDriver) Diff(id, parent string) (arch io.ReadCloser, err err
 	}
 	defer driver.Put(parent)
 
-	changes, err := archive.ChangesDirs(layerFs, parentFs)
+	changes, err := changesDirsParallel(ctx, layerFs, parentFs, ChangesParallelism)
 	if err != nil {
 		return nil, err
 	}
@@ -86,7 +323,8 @@ func (gdw *NaiveDiffDriver) Diff(id, parent string) (arch io.ReadCloser, err err
 		return nil, err
 	}
 
-	return ioutils.NewReadCloserWrapper(archive, func() error {
+	cr := &ctxReader{ctx: ctx, r: archive, opts: opts}
+	return ioutils.NewReadCloserWrapper(cr, func() error {
 		err := archive.Close()
 		driver.Put(id)
 
@@ -99,9 +337,64 @@ func (gdw *NaiveDiffDriver) Diff(id, parent string) (arch io.ReadCloser, err err
 	}), nil
 }
 
+// DiffWithOptions produces an archive of the changes between id and parent,
+// compressed per opts.Compression. If the wrapped ProtoDriver also
+// implements CompressedDiffer, that takes priority and this naive
+// implementation is not used. Otherwise the naive uncompressed tar is piped
+// through archive.CompressStream. The returned io.ReadCloser's Close still
+// drives driver.Put(id) exactly once, and (when parent is set, as in Diff)
+// the one-second mtime sleep exactly once, whatever compression was
+// requested.
+//
+// DiffWithOptions is not part of the Driver interface: it's a concrete
+// method on *NaiveDiffDriver (see the matching note on NewNaiveDiffDriver).
+// A caller holding only the Driver NewNaiveDiffDriver returns can't reach it
+// without its own type assertion against *NaiveDiffDriver.
+func (gdw *NaiveDiffDriver) DiffWithOptions(id, parent string, opts DiffOptions) (io.ReadCloser, error) {
+	if cd, ok := gdw.ProtoDriver.(CompressedDiffer); ok {
+		return cd.DiffWithOptions(id, parent, opts)
+	}
+
+	arch, err := gdw.DiffContext(context.Background(), id, parent, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Compression == archive.Uncompressed {
+		return arch, nil
+	}
+
+	pr, pw := io.Pipe()
+	compressor, err := archive.CompressStream(pw, opts.Compression)
+	if err != nil {
+		arch.Close()
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(compressor, arch)
+		if cerr := compressor.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return ioutils.NewReadCloserWrapper(pr, func() error {
+		pr.Close()
+		return arch.Close()
+	}), nil
+}
+
 // Changes produces a list of changes between the specified layer
 // and its parent layer. If parent is "", then all changes will be ADD changes.
+// The result is served from gdw's change cache when available, and the walk
+// that populates the cache fans out across ChangesParallelism goroutines.
 func (gdw *NaiveDiffDriver) Changes(id, parent string) ([]archive.Change, error) {
+	useCache := gdw.cacheEnabled()
+	key := changeCacheKey{id: id, parent: parent, generation: gdw.generation(id)}
+	if useCache {
+		if v, ok := gdw.cache.get(key); ok {
+			return v.changes, nil
+		}
+	}
+
 	driver := gdw.ProtoDriver
 
 	layerFs, err := driver.Get(id, "")
@@ -120,13 +413,195 @@ func (gdw *NaiveDiffDriver) Changes(id, parent string) ([]archive.Change, error)
 		defer driver.Put(parent)
 	}
 
-	return archive.ChangesDirs(layerFs, parentFs)
+	changes, err := changesDirsParallel(context.Background(), layerFs, parentFs, ChangesParallelism)
+	if err != nil {
+		return nil, err
+	}
+
+	if useCache {
+		gdw.cache.put(key, changeCacheValue{changes: changes, size: archive.ChangesSize(layerFs, changes)})
+	}
+	return changes, nil
+}
+
+// changesDirsParallel computes the same result as archive.ChangesDirs, but
+// fans the walk out across up to parallelism goroutines, one per top-level
+// entry present in either layerFs or parentFs - see changesDirsParallelOne
+// for how a name present on only one side is handled. ctx is checked before
+// each top-level entry is dispatched, so a cancellation lands promptly
+// instead of waiting for the whole walk - including any already-dispatched
+// entries - to finish.
+func changesDirsParallel(ctx context.Context, layerFs, parentFs string, parallelism int) ([]archive.Change, error) {
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	layerNames := make(map[string]struct{})
+	layerEntries, err := os.ReadDir(layerFs)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range layerEntries {
+		layerNames[e.Name()] = struct{}{}
+	}
+
+	parentNames := make(map[string]struct{})
+	if parentFs != "" {
+		parentEntries, err := os.ReadDir(parentFs)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range parentEntries {
+			parentNames[e.Name()] = struct{}{}
+		}
+	}
+
+	names := make(map[string]struct{}, len(layerNames)+len(parentNames))
+	for name := range layerNames {
+		names[name] = struct{}{}
+	}
+	for name := range parentNames {
+		names[name] = struct{}{}
+	}
+
+	sem := make(chan struct{}, parallelism)
+	out := make(chan changesDirsResult, len(names))
+	dispatched := 0
+	for name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		name := name
+		_, inLayer := layerNames[name]
+		_, inParent := parentNames[name]
+		dispatched++
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		go func() {
+			defer func() { <-sem }()
+			out <- changesDirsParallelOne(layerFs, parentFs, name, inLayer, inParent)
+		}()
+	}
+
+	var all []archive.Change
+	for i := 0; i < dispatched; i++ {
+		var r changesDirsResult
+		select {
+		case r = <-out:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		all = append(all, r.changes...)
+	}
+	return all, nil
+}
+
+// changesDirsResult is the per-top-level-entry outcome fed back to
+// changesDirsParallel over its result channel.
+type changesDirsResult struct {
+	changes []archive.Change
+	err     error
+}
+
+// changesDirsParallelOne computes the changes under a single top-level name,
+// given whether that name is present in layerFs, parentFs, or both.
+func changesDirsParallelOne(layerFs, parentFs, name string, inLayer, inParent bool) changesDirsResult {
+	path := string(filepath.Separator) + name
+
+	if inParent && !inLayer {
+		// Removed entirely at the top level: report the single deletion
+		// directly instead of walking a directory that no longer exists,
+		// which is what a plain filepath.Join + ChangesDirs call would do.
+		return changesDirsResult{changes: []archive.Change{{Path: path, Kind: archive.ChangeDelete}}}
+	}
+
+	layerSub := filepath.Join(layerFs, name)
+	parentSub := ""
+	if inParent {
+		parentSub = filepath.Join(parentFs, name)
+	}
+	// inLayer && !inParent: brand new at the top level. Passing "" for
+	// parentSub is ChangesDirs's documented sentinel for "this side
+	// doesn't exist", the same convention Changes relies on when there is
+	// no parent layer at all - not a dangling, nonexistent path.
+
+	changes, err := archive.ChangesDirs(layerSub, parentSub)
+	if err != nil {
+		return changesDirsResult{err: err}
+	}
+	for i := range changes {
+		changes[i].Path = filepath.Join(path, changes[i].Path)
+	}
+	if parentSub == "" {
+		// ChangesDirs never reports layerSub itself, only what is under it,
+		// so the new top-level entry gets its own ADD ahead of its contents.
+		changes = append([]archive.Change{{Path: path, Kind: archive.ChangeAdd}}, changes...)
+	}
+
+	if parentSub != "" {
+		// ChangesDirs only reports changes to layerSub's contents, not to
+		// layerSub itself - its own mode/owner/mtime is the walk root, not
+		// a walked entry - so a bare chmod/chown/utimes on the top-level
+		// directory would otherwise be silently dropped.
+		changed, err := topEntryChanged(layerSub, parentSub)
+		if err != nil {
+			return changesDirsResult{err: err}
+		}
+		if changed {
+			changes = append(changes, archive.Change{Path: path, Kind: archive.ChangeModify})
+		}
+	}
+
+	return changesDirsResult{changes: changes}
+}
+
+// topEntryChanged reports whether the directory entry at layerSub itself -
+// its permission bits, ownership, or modification time - differs from
+// parentSub.
+func topEntryChanged(layerSub, parentSub string) (bool, error) {
+	layerInfo, err := os.Lstat(layerSub)
+	if err != nil {
+		return false, err
+	}
+	parentInfo, err := os.Lstat(parentSub)
+	if err != nil {
+		return false, err
+	}
+	if layerInfo.Mode() != parentInfo.Mode() || !layerInfo.ModTime().Equal(parentInfo.ModTime()) {
+		return true, nil
+	}
+	layerStat, ok1 := layerInfo.Sys().(*syscall.Stat_t)
+	parentStat, ok2 := parentInfo.Sys().(*syscall.Stat_t)
+	if ok1 && ok2 && (layerStat.Uid != parentStat.Uid || layerStat.Gid != parentStat.Gid) {
+		return true, nil
+	}
+	return false, nil
 }
 
 // ApplyDiff extracts the changeset from the given diff into the
 // layer with the specified id and parent, returning the size of the
 // new layer in bytes.
 func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, diff io.Reader) (size int64, err error) {
+	return gdw.ApplyDiffContext(context.Background(), id, parent, diff, nil)
+}
+
+// ApplyDiffContext is the context-aware, cancellable form of ApplyDiff. ctx
+// is checked between reads of diff; if it is cancelled mid-extraction, the
+// next read fails with ctx.Err() and ApplyUncompressedLayer returns an
+// error. Whatever had already been written into the target layer is left in
+// place; it is not removed. opts.Progress (if set) is kept up to date with
+// bytes processed along the way.
+func (gdw *NaiveDiffDriver) ApplyDiffContext(ctx context.Context, id, parent string, diff io.Reader, opts *DiffOptions) (size int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	driver := gdw.ProtoDriver
 
 	// Mount the root filesystem so we can apply the diff/layer.
@@ -140,7 +615,10 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, diff io.Reader) (size i
 		GIDMaps: gdw.gidMaps}
 	start := time.Now().UTC()
 	logrus.Debug("Start untar layer")
-	if size, err = ApplyUncompressedLayer(layerFs, diff, options); err != nil {
+	cr := &ctxReader{ctx: ctx, r: diff, opts: opts}
+	size, err = ApplyUncompressedLayer(layerFs, cr, options)
+	gdw.cache.invalidate(id)
+	if err != nil {
 		return
 	}
 	logrus.Debugf("Untar time: %vs", time.Now().UTC().Sub(start).Seconds())
@@ -148,22 +626,191 @@ func (gdw *NaiveDiffDriver) ApplyDiff(id, parent string, diff io.Reader) (size i
 	return
 }
 
+// Create creates a new, empty layer with the given id and parent, then
+// invalidates any cached Changes/DiffSize results that name either one.
+func (gdw *NaiveDiffDriver) Create(id, parent string, opts *CreateOpts) error {
+	err := gdw.ProtoDriver.Create(id, parent, opts)
+	gdw.cache.invalidate(id)
+	gdw.cache.invalidate(parent)
+	return err
+}
+
+// CreateReadWrite creates a new, empty, read-write layer with the given id
+// and parent, then invalidates any cached Changes/DiffSize results that name
+// either one.
+func (gdw *NaiveDiffDriver) CreateReadWrite(id, parent string, opts *CreateOpts) error {
+	err := gdw.ProtoDriver.CreateReadWrite(id, parent, opts)
+	gdw.cache.invalidate(id)
+	gdw.cache.invalidate(parent)
+	return err
+}
+
+// Remove deletes the layer with the given id, then invalidates any cached
+// Changes/DiffSize results that name it.
+func (gdw *NaiveDiffDriver) Remove(id string) error {
+	err := gdw.ProtoDriver.Remove(id)
+	gdw.cache.invalidate(id)
+	return err
+}
+
 // DiffSize calculates the changes between the specified layer
 // and its parent and returns the size in bytes of the changes
-// relative to its base filesystem directory.
+// relative to its base filesystem directory. A cached size is returned
+// without mounting either layer when the change cache already has one.
 func (gdw *NaiveDiffDriver) DiffSize(id, parent string) (size int64, err error) {
-	driver := gdw.ProtoDriver
+	useCache := gdw.cacheEnabled()
+	key := changeCacheKey{id: id, parent: parent, generation: gdw.generation(id)}
+	if useCache {
+		if v, ok := gdw.cache.get(key); ok {
+			return v.size, nil
+		}
+	}
 
 	changes, err := gdw.Changes(id, parent)
 	if err != nil {
 		return
 	}
 
+	// Changes already computed and cached the size alongside the change
+	// list on a cache miss; reuse it instead of re-mounting id and
+	// re-walking the change set a second time.
+	if useCache {
+		if v, ok := gdw.cache.get(key); ok {
+			return v.size, nil
+		}
+	}
+
+	driver := gdw.ProtoDriver
+
 	layerFs, err := driver.Get(id, "")
 	if err != nil {
 		return
 	}
 	defer driver.Put(id)
 
-	return archive.ChangesSize(layerFs, changes), nil
+	size = archive.ChangesSize(layerFs, changes)
+	if useCache {
+		gdw.cache.put(key, changeCacheValue{changes: changes, size: size})
+	}
+	return size, nil
+}
+
+// ChangesChain produces the changes id carries relative to ancestors[0], the
+// oldest ancestor in the chain, as if every layer in between had been
+// squashed away. ancestors must be ordered oldest-first.
+//
+// The bulk of the result comes from a single Changes(id, ancestors[0]) call:
+// comparing the two trees directly already yields the correct net ADD,
+// MODIFY, and DELETE set. On top of that, this walks each layer-to-layer
+// step once, collects the deletions each step made (e.g. as part of marking
+// a directory opaque), and reinserts every one that the direct comparison
+// doesn't already report and whose path is absent from id itself - checked
+// against id, not merely against whether the top-level diff mentions the
+// path. A path that's present in id (identical content or not) never gets a
+// delete, so a path that an intermediate layer deleted and a later layer
+// recreated identical to ancestors[0]'s produces no change at all.
+//
+// ChangesChain is not part of the Driver interface: it's a concrete method
+// on *NaiveDiffDriver, reachable the same way as DiffContext and
+// DiffWithOptions (see the note on NewNaiveDiffDriver).
+func (gdw *NaiveDiffDriver) ChangesChain(id string, ancestors []string) ([]archive.Change, error) {
+	if len(ancestors) == 0 {
+		return gdw.Changes(id, "")
+	}
+
+	oldest := ancestors[0]
+	changes, err := gdw.Changes(id, oldest)
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[string]bool, len(changes))
+	for _, c := range changes {
+		present[c.Path] = true
+	}
+
+	var idFs string
+	steps := append(append([]string{}, ancestors[1:]...), id)
+	parent := oldest
+	for _, next := range steps {
+		intermediate, err := gdw.Changes(next, parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range intermediate {
+			if c.Kind != archive.ChangeDelete || present[c.Path] {
+				continue
+			}
+
+			if idFs == "" {
+				idFs, err = gdw.ProtoDriver.Get(id, "")
+				if err != nil {
+					return nil, err
+				}
+				defer gdw.ProtoDriver.Put(id)
+			}
+			if _, statErr := os.Lstat(filepath.Join(idFs, c.Path)); statErr == nil {
+				// Recreated - possibly with content identical to
+				// ancestors[0]'s, which is why it didn't show up in the
+				// direct comparison above - so it must not be deleted
+				// again.
+				continue
+			} else if !os.IsNotExist(statErr) {
+				return nil, statErr
+			}
+
+			changes = append(changes, c)
+			present[c.Path] = true
+		}
+		parent = next
+	}
+
+	return changes, nil
+}
+
+// DiffChain produces an archive of ChangesChain(id, ancestors): the net tar
+// representing id applied on top of ancestors[0] (or from scratch if
+// ancestors is empty). ancestors must be ordered oldest-first. The returned
+// io.ReadCloser's Close drives driver.Put(id) and the one-second mtime sleep
+// exactly once, the same as Diff.
+//
+// Like ChangesChain, DiffChain is not part of the Driver interface; see the
+// note on NewNaiveDiffDriver.
+func (gdw *NaiveDiffDriver) DiffChain(id string, ancestors []string) (arch io.ReadCloser, err error) {
+	if len(ancestors) == 0 {
+		return gdw.Diff(id, "")
+	}
+
+	startTime := time.Now()
+	driver := gdw.ProtoDriver
+
+	layerFs, err := driver.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			driver.Put(id)
+		}
+	}()
+
+	changes, err := gdw.ChangesChain(id, ancestors)
+	if err != nil {
+		return nil, err
+	}
+
+	archOut, err := archive.ExportChanges(layerFs, changes, gdw.uidMaps, gdw.gidMaps)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutils.NewReadCloserWrapper(archOut, func() error {
+		err := archOut.Close()
+		driver.Put(id)
+
+		// See the matching comment in Diff: keep mtime comparisons stable
+		// across calls within the same second.
+		time.Sleep(time.Until(startTime.Truncate(time.Second).Add(time.Second)))
+		return err
+	}), nil
 }
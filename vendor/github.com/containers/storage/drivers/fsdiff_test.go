@@ -0,0 +1,249 @@
+package graphdriver
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/containers/storage/pkg/archive"
+)
+
+func TestChangeCacheLRUEviction(t *testing.T) {
+	c := newChangeCache(2)
+
+	k1 := changeCacheKey{id: "a"}
+	k2 := changeCacheKey{id: "b"}
+	k3 := changeCacheKey{id: "c"}
+
+	c.put(k1, changeCacheValue{size: 1})
+	c.put(k2, changeCacheValue{size: 2})
+
+	// Touch k1 so k2 becomes the least recently used entry.
+	if _, ok := c.get(k1); !ok {
+		t.Fatalf("expected k1 to be cached")
+	}
+
+	// Capacity is 2: adding k3 must evict k2, not k1.
+	c.put(k3, changeCacheValue{size: 3})
+
+	if _, ok := c.get(k2); ok {
+		t.Errorf("expected k2 to have been evicted as least recently used")
+	}
+	if _, ok := c.get(k1); !ok {
+		t.Errorf("expected k1 to still be cached")
+	}
+	if _, ok := c.get(k3); !ok {
+		t.Errorf("expected k3 to still be cached")
+	}
+}
+
+func TestChangeCacheInvalidate(t *testing.T) {
+	// Create, CreateReadWrite, Remove, and ApplyDiffContext all drive
+	// invalidation through changeCache.invalidate(id) exactly like this.
+	c := newChangeCache(64)
+
+	c.put(changeCacheKey{id: "layer", parent: "base"}, changeCacheValue{size: 1})
+	c.put(changeCacheKey{id: "other", parent: "layer"}, changeCacheValue{size: 2})
+	c.put(changeCacheKey{id: "unrelated", parent: "base2"}, changeCacheValue{size: 3})
+
+	c.invalidate("layer")
+
+	if _, ok := c.get(changeCacheKey{id: "layer", parent: "base"}); ok {
+		t.Errorf("expected entry keyed by id=layer to be invalidated")
+	}
+	if _, ok := c.get(changeCacheKey{id: "other", parent: "layer"}); ok {
+		t.Errorf("expected entry keyed by parent=layer to be invalidated")
+	}
+	if _, ok := c.get(changeCacheKey{id: "unrelated", parent: "base2"}); !ok {
+		t.Errorf("expected unrelated entry to survive invalidation")
+	}
+}
+
+func TestChangesDirsParallelTopLevelAddAndDelete(t *testing.T) {
+	layerFs := t.TempDir()
+	parentFs := t.TempDir()
+
+	// "added" only exists in the layer; "removed" only exists in the
+	// parent. Neither should make ChangesDirs walk a nonexistent path.
+	if err := os.MkdirAll(filepath.Join(layerFs, "added", "nested"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layerFs, "added", "nested", "file"), []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(parentFs, "removed"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := changesDirsParallel(context.Background(), layerFs, parentFs, ChangesParallelism)
+	if err != nil {
+		t.Fatalf("changesDirsParallel: %v", err)
+	}
+
+	var addedPaths, deletedPaths []string
+	for _, c := range changes {
+		switch c.Kind {
+		case archive.ChangeAdd:
+			addedPaths = append(addedPaths, c.Path)
+		case archive.ChangeDelete:
+			deletedPaths = append(deletedPaths, c.Path)
+		}
+	}
+	sort.Strings(addedPaths)
+	sort.Strings(deletedPaths)
+
+	if len(deletedPaths) != 1 || deletedPaths[0] != string(filepath.Separator)+"removed" {
+		t.Errorf("expected a single delete for /removed, got %v", deletedPaths)
+	}
+
+	foundAdd := false
+	for _, p := range addedPaths {
+		if p == filepath.Join(string(filepath.Separator)+"added", "nested", "file") {
+			foundAdd = true
+		}
+	}
+	if !foundAdd {
+		t.Errorf("expected an add for the file under the new top-level directory, got %v", addedPaths)
+	}
+}
+
+// TestChangesChainAcrossLayers builds a real three-layer chain - base, an
+// intermediate layer, and id itself - and drives it through ChangesChain
+// and DiffChain rather than poking changesDirsParallel directly, so it
+// actually exercises the intermediate-layer walk ChangesChain does on top
+// of its direct Changes(id, ancestors[0]) comparison.
+func TestChangesChainAcrossLayers(t *testing.T) {
+	pd := newFakeProtoDriver(t)
+	gdw := &NaiveDiffDriver{ProtoDriver: pd, cache: newChangeCache(changeCacheCapacity)}
+
+	const base, mid, id = "base", "mid", "id"
+
+	baseDir, err := pd.Get(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, baseDir, "survivor", "orig")
+	writeFile(t, baseDir, "gone", "x")
+	writeFile(t, baseDir, "untouched", "same")
+
+	// mid marks a directory opaque by deleting both "survivor" and
+	// "gone"; only "untouched" carries forward unchanged.
+	midDir, err := pd.Get(mid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, midDir, "untouched", "same")
+
+	// id recreates "survivor" with content identical to base's - the
+	// resurrected-path case - but never recreates "gone".
+	idDir, err := pd.Get(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, idDir, "survivor", "orig")
+	writeFile(t, idDir, "untouched", "same")
+	// Identical includes the mtime, which the metadata comparison checks.
+	for _, name := range []string{"survivor", "untouched"} {
+		fi, err := os.Stat(filepath.Join(baseDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(idDir, name), fi.ModTime(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changes, err := gdw.ChangesChain(id, []string{base, mid})
+	if err != nil {
+		t.Fatalf("ChangesChain: %v", err)
+	}
+
+	var deleted []string
+	for _, c := range changes {
+		if c.Path == string(filepath.Separator)+"survivor" {
+			t.Errorf("expected no change for the resurrected path %q, got %+v", c.Path, c)
+		}
+		if c.Path == string(filepath.Separator)+"untouched" {
+			t.Errorf("expected no change for the untouched path, got %+v", c)
+		}
+		if c.Kind == archive.ChangeDelete {
+			deleted = append(deleted, c.Path)
+		}
+	}
+	if want := string(filepath.Separator) + "gone"; len(deleted) != 1 || deleted[0] != want {
+		t.Errorf("expected exactly one delete for %q, got %v", want, deleted)
+	}
+
+	rc, err := gdw.DiffChain(id, []string{base, mid})
+	if err != nil {
+		t.Fatalf("DiffChain: %v", err)
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	names := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading DiffChain tar: %v", err)
+		}
+		names[strings.TrimPrefix(hdr.Name, "./")] = true
+	}
+	if names["survivor"] {
+		t.Errorf("expected no entry for the resurrected path in the diff tar, got entries %v", names)
+	}
+	if !names[".wh.gone"] {
+		t.Errorf("expected a whiteout for the deleted path in the diff tar, got entries %v", names)
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestChangesDirsParallelAbortsOnCancelledContext covers the walk-level half
+// of DiffContext's cancellation: a context cancelled before (or during) the
+// top-level fan-out must stop the walk instead of running it to completion.
+func TestChangesDirsParallelAbortsOnCancelledContext(t *testing.T) {
+	layerFs := t.TempDir()
+	for i := 0; i < 8; i++ {
+		if err := os.Mkdir(filepath.Join(layerFs, string(rune('a'+i))), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := changesDirsParallel(ctx, layerFs, "", ChangesParallelism)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestCtxReaderAbortsOnCancelledContext covers the streaming half of
+// DiffContext's (and ApplyDiffContext's) cancellation: once ctx is
+// cancelled, Read must fail with ctx.Err() instead of returning the
+// underlying reader's data.
+func TestCtxReaderAbortsOnCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cr := &ctxReader{ctx: ctx, r: strings.NewReader("data that must not be returned")}
+	n, err := cr.Read(make([]byte, 4))
+	if n != 0 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a zero-byte read failing with context.Canceled, got n=%d err=%v", n, err)
+	}
+}